@@ -0,0 +1,429 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxEventsPerBatch is Mixpanel's documented per-POST cap for
+	// /track#live-import.
+	MaxEventsPerBatch = 50
+)
+
+// QueuePolicy controls what Enqueue does when the in-memory queue is full.
+type QueuePolicy int
+
+const (
+	// DropOldest discards the oldest queued event to make room for the new
+	// one, favoring recency over completeness.
+	DropOldest QueuePolicy = iota
+	// BlockProducer makes Enqueue block until space is available.
+	BlockProducer
+)
+
+// Persister lets failed batches survive a process restart. Save is called
+// with the still-undelivered batch's JSON-encoded events; Load is called
+// once at startup so those batches can be retried before new ones.
+type Persister interface {
+	Save(batch [][]byte) error
+	Load() ([][]byte, error)
+}
+
+// BatchOptions configures a BatchClient. The zero value is not usable;
+// construct via DefaultBatchOptions and override individual fields.
+type BatchOptions struct {
+	// BatchSize is the number of events per /track POST. Capped at
+	// MaxEventsPerBatch.
+	BatchSize int
+	// FlushInterval is how long Enqueue lets events sit before a
+	// partial batch is flushed anyway.
+	FlushInterval time.Duration
+	// EventsPerSecond throttles outgoing events across all batches. Zero
+	// means unlimited.
+	EventsPerSecond float64
+	// QueueSize is the capacity of the in-memory event queue.
+	QueueSize int
+	// QueuePolicy decides Enqueue's behavior once the queue is full.
+	QueuePolicy QueuePolicy
+	// MaxRetries is the number of retry attempts for a batch that fails
+	// with a retryable error (429 or 5xx) before it's handed to
+	// Persister, if any.
+	MaxRetries int
+	// Persister optionally spools batches that exhaust their retries so
+	// they can be resent on the next start.
+	Persister Persister
+}
+
+// DefaultBatchOptions returns sane defaults for server-side tracking.
+func DefaultBatchOptions() BatchOptions {
+	return BatchOptions{
+		BatchSize:       MaxEventsPerBatch,
+		FlushInterval:   5 * time.Second,
+		EventsPerSecond: 0,
+		QueueSize:       10000,
+		QueuePolicy:     DropOldest,
+		MaxRetries:      5,
+	}
+}
+
+type trackEvent struct {
+	DistinctID string
+	Event      string
+	Properties map[string]interface{}
+}
+
+// BatchClient is an async, rate-limited producer on top of Mixpanel.Track.
+// Enqueue never blocks the caller on network I/O; background workers batch
+// and flush events to Mixpanel.
+type BatchClient struct {
+	m    *Mixpanel
+	opts BatchOptions
+
+	mu     sync.Mutex
+	queue  []trackEvent
+	notify chan struct{}
+
+	flushReq  chan chan struct{}
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewBatchClient starts a BatchClient backed by m. Any batches left over
+// from a previous run are loaded from opts.Persister and retried first.
+func NewBatchClient(m *Mixpanel, opts BatchOptions) *BatchClient {
+	if opts.BatchSize <= 0 || opts.BatchSize > MaxEventsPerBatch {
+		opts.BatchSize = MaxEventsPerBatch
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 5
+	}
+
+	bc := &BatchClient{
+		m:        m,
+		opts:     opts,
+		notify:   make(chan struct{}, 1),
+		flushReq: make(chan chan struct{}),
+		closeCh:  make(chan struct{}),
+	}
+
+	bc.wg.Add(1)
+	go bc.loop()
+
+	if opts.Persister != nil {
+		bc.replayPersisted()
+	}
+
+	return bc
+}
+
+// Enqueue queues event for eventual delivery. It is non-blocking unless
+// opts.QueuePolicy is BlockProducer and the queue is full.
+func (bc *BatchClient) Enqueue(distinctID, event string, props map[string]interface{}) {
+	ev := trackEvent{DistinctID: distinctID, Event: event, Properties: props}
+
+	bc.mu.Lock()
+	for len(bc.queue) >= bc.opts.QueueSize {
+		if bc.opts.QueuePolicy == DropOldest {
+			bc.queue = bc.queue[1:]
+			break
+		}
+		bc.mu.Unlock()
+		time.Sleep(time.Millisecond)
+		bc.mu.Lock()
+	}
+	bc.queue = append(bc.queue, ev)
+	bc.mu.Unlock()
+
+	select {
+	case bc.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Flush blocks until every event queued before the call returns has been
+// flushed (successfully or to the Persister), or ctx is done. Safe to call
+// concurrently with Close: loop() closes out any pending Flush before it
+// exits rather than leaving the call blocked forever.
+func (bc *BatchClient) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case bc.flushReq <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the background workers after flushing whatever is queued.
+func (bc *BatchClient) Close() error {
+	bc.closeOnce.Do(func() {
+		close(bc.closeCh)
+		bc.wg.Wait()
+	})
+	return nil
+}
+
+func (bc *BatchClient) loop() {
+	defer bc.wg.Done()
+
+	ticker := time.NewTicker(bc.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var limiter *rateLimiter
+	if bc.opts.EventsPerSecond > 0 {
+		limiter = newRateLimiter(bc.opts.EventsPerSecond, bc.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case <-bc.notify:
+			bc.drain(limiter)
+		case <-ticker.C:
+			bc.drain(limiter)
+		case done := <-bc.flushReq:
+			bc.drain(limiter)
+			close(done)
+		case <-bc.closeCh:
+			bc.drain(limiter)
+			bc.unblockPendingFlushes()
+			return
+		}
+	}
+}
+
+// unblockPendingFlushes closes out any Flush call that's already blocked
+// sending on flushReq by the time loop's select above picks closeCh
+// instead of it -- otherwise that Flush would block forever with nothing
+// left to receive its send.
+func (bc *BatchClient) unblockPendingFlushes() {
+	for {
+		select {
+		case done := <-bc.flushReq:
+			close(done)
+		default:
+			return
+		}
+	}
+}
+
+func (bc *BatchClient) drain(limiter *rateLimiter) {
+	for {
+		batch := bc.takeBatch()
+		if len(batch) == 0 {
+			return
+		}
+		if limiter != nil {
+			limiter.WaitN(len(batch))
+		}
+		bc.send(batch)
+	}
+}
+
+func (bc *BatchClient) takeBatch() []trackEvent {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if len(bc.queue) == 0 {
+		return nil
+	}
+	n := bc.opts.BatchSize
+	if n > len(bc.queue) {
+		n = len(bc.queue)
+	}
+	batch := bc.queue[:n]
+	bc.queue = bc.queue[n:]
+	return batch
+}
+
+func (bc *BatchClient) send(batch []trackEvent) {
+	token := bc.m.Auth.projectToken()
+	if token == "" {
+		log.Printf("mixpanel: dropping batch of %d events: %s", len(batch), ErrNoProjectToken)
+		return
+	}
+
+	payload := make([]map[string]interface{}, len(batch))
+	for i, ev := range batch {
+		props := cloneProps(ev.Properties)
+		props["token"] = token
+		props["distinct_id"] = ev.DistinctID
+		payload[i] = map[string]interface{}{
+			"event":      ev.Event,
+			"properties": props,
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("mixpanel: dropping unmarshalable batch of %d events: %s", len(batch), err)
+		return
+	}
+
+	for attempt := 0; attempt <= bc.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffWithJitter(attempt))
+		}
+		retryable, err := bc.postBatch(data)
+		if err == nil {
+			return
+		}
+		if !retryable {
+			log.Printf("mixpanel: batch of %d events rejected: %s", len(batch), err)
+			return
+		}
+	}
+
+	if bc.opts.Persister != nil {
+		if err := bc.opts.Persister.Save([][]byte{data}); err != nil {
+			log.Printf("mixpanel: failed to spool undelivered batch: %s", err)
+		}
+		return
+	}
+	log.Printf("mixpanel: dropping batch of %d events after %d retries", len(batch), bc.opts.MaxRetries)
+}
+
+// postBatch returns (retryable, err). err is nil on success.
+func (bc *BatchClient) postBatch(data []byte) (bool, error) {
+	form := url.Values{}
+	form.Set("data", base64.StdEncoding.EncodeToString(data))
+	uri := bc.m.IngestBaseUrl + "/track#live-import"
+
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := bc.m.HTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, fmt.Errorf("mixpanel: %d: %s", resp.StatusCode, body)
+	}
+	if strings.TrimSpace(string(body)) != "1" {
+		return false, ErrTrackFailed{Body: string(body), Resp: resp}
+	}
+	return false, nil
+}
+
+func (bc *BatchClient) replayPersisted() {
+	batches, err := bc.opts.Persister.Load()
+	if err != nil {
+		log.Printf("mixpanel: failed to load persisted batches: %s", err)
+		return
+	}
+	for _, data := range batches {
+		bc.replayBatch(data)
+	}
+}
+
+// replayBatch retries a single persisted batch, mirroring send()'s
+// exhaustion handling: a non-retryable rejection is logged and dropped,
+// but exhausting MaxRetries on a still-retryable error re-spools the
+// batch rather than silently losing it.
+func (bc *BatchClient) replayBatch(data []byte) {
+	for attempt := 0; attempt <= bc.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffWithJitter(attempt))
+		}
+		retryable, err := bc.postBatch(data)
+		if err == nil {
+			return
+		}
+		if !retryable {
+			log.Printf("mixpanel: persisted batch rejected: %s", err)
+			return
+		}
+	}
+
+	if err := bc.opts.Persister.Save([][]byte{data}); err != nil {
+		log.Printf("mixpanel: failed to re-spool persisted batch: %s", err)
+	}
+}
+
+func backoffWithJitter(attempt int) time.Duration {
+	base := time.Duration(1<<uint(attempt)) * 100 * time.Millisecond
+	jitter := time.Duration(rand.Int63n(int64(base) + 1))
+	return base + jitter
+}
+
+// rateLimiter is a minimal token bucket; it exists so BatchClient doesn't
+// need an external dependency for something this small.
+type rateLimiter struct {
+	mu         sync.Mutex
+	tokens     float64
+	maxTokens  float64
+	perSecond  float64
+	lastRefill time.Time
+}
+
+// newRateLimiter paces events at eventsPerSecond. burstCap is the largest
+// single WaitN call the caller will make (its batch size); maxTokens must
+// be at least that large or WaitN(burstCap) would demand more tokens than
+// the bucket could ever hold and block forever.
+func newRateLimiter(eventsPerSecond float64, burstCap int) *rateLimiter {
+	maxTokens := eventsPerSecond
+	if float64(burstCap) > maxTokens {
+		maxTokens = float64(burstCap)
+	}
+	return &rateLimiter{
+		tokens:     maxTokens,
+		maxTokens:  maxTokens,
+		perSecond:  eventsPerSecond,
+		lastRefill: time.Now(),
+	}
+}
+
+func (r *rateLimiter) WaitN(n int) {
+	if float64(n) > r.maxTokens {
+		n = int(r.maxTokens)
+	}
+	for {
+		r.mu.Lock()
+		now := time.Now()
+		r.tokens += now.Sub(r.lastRefill).Seconds() * r.perSecond
+		if r.tokens > r.maxTokens {
+			r.tokens = r.maxTokens
+		}
+		r.lastRefill = now
+		if r.tokens >= float64(n) {
+			r.tokens -= float64(n)
+			r.mu.Unlock()
+			return
+		}
+		wait := time.Duration((float64(n)-r.tokens)/r.perSecond*1000) * time.Millisecond
+		r.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,193 @@
+package mixpanel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEnqueueDropOldestDiscardsOldestOnFull(t *testing.T) {
+	bc := &BatchClient{
+		opts:   BatchOptions{QueueSize: 2, QueuePolicy: DropOldest},
+		notify: make(chan struct{}, 1),
+	}
+
+	bc.Enqueue("u1", "first", nil)
+	bc.Enqueue("u2", "second", nil)
+	bc.Enqueue("u3", "third", nil)
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if len(bc.queue) != 2 {
+		t.Fatalf("queue len = %d, want 2", len(bc.queue))
+	}
+	if bc.queue[0].Event != "second" || bc.queue[1].Event != "third" {
+		t.Fatalf("queue = %v, want [second third]", bc.queue)
+	}
+}
+
+func TestEnqueueBlockProducerWaitsForSpace(t *testing.T) {
+	bc := &BatchClient{
+		opts:   BatchOptions{QueueSize: 1, QueuePolicy: BlockProducer},
+		notify: make(chan struct{}, 1),
+	}
+
+	bc.Enqueue("u1", "first", nil)
+
+	done := make(chan struct{})
+	go func() {
+		bc.Enqueue("u2", "second", nil)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Enqueue returned while queue was full under BlockProducer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bc.mu.Lock()
+	bc.queue = bc.queue[1:]
+	bc.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue never unblocked after space freed")
+	}
+}
+
+func TestRateLimiterWaitNDoesNotDeadlockWhenBatchExceedsEventsPerSecond(t *testing.T) {
+	// Regression test for a burst cap bug: maxTokens used to equal
+	// eventsPerSecond, so WaitN(burstCap) with burstCap > eventsPerSecond
+	// could never be satisfied and looped forever.
+	limiter := newRateLimiter(10, 50)
+
+	done := make(chan struct{})
+	go func() {
+		limiter.WaitN(50)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("WaitN(50) deadlocked with EventsPerSecond=10")
+	}
+}
+
+func TestRateLimiterWaitNThrottlesToConfiguredRate(t *testing.T) {
+	limiter := newRateLimiter(1000, 10)
+	limiter.tokens = 0
+
+	start := time.Now()
+	limiter.WaitN(10)
+	elapsed := time.Since(start)
+
+	// 10 events at 1000/sec should take on the order of 10ms, not instant
+	// and not seconds.
+	if elapsed > time.Second {
+		t.Fatalf("WaitN(10) took %s, want well under 1s", elapsed)
+	}
+}
+
+func TestRateLimiterWaitNConcurrentCallersAllComplete(t *testing.T) {
+	limiter := newRateLimiter(500, 20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.WaitN(20)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("concurrent WaitN callers never all completed")
+	}
+}
+
+func TestFlushRacingCloseDoesNotDeadlock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("1"))
+	}))
+	defer server.Close()
+
+	// Regression test: loop() used to return on <-bc.closeCh without
+	// unblocking a Flush that was already mid-send on flushReq, leaving
+	// that Flush call hung forever. Run it enough times, with Flush and
+	// Close issued close together, to make the race reliably surface.
+	for i := 0; i < 20; i++ {
+		m := NewMixpanelWithAuth(ProjectTokenAuth{Token: "tok"})
+		m.IngestBaseUrl = server.URL
+		opts := DefaultBatchOptions()
+		opts.FlushInterval = time.Hour
+		bc := NewBatchClient(m, opts)
+		bc.Enqueue("u", "e", nil)
+
+		flushErr := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			flushErr <- bc.Flush(ctx)
+		}()
+		time.Sleep(5 * time.Millisecond)
+		bc.Close()
+
+		select {
+		case err := <-flushErr:
+			if err != nil {
+				t.Fatalf("run %d: Flush returned %s, want nil", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("run %d: Flush never returned after Close", i)
+		}
+	}
+}
+
+type fakePersister struct {
+	mu    sync.Mutex
+	saved [][]byte
+}
+
+func (p *fakePersister) Load() ([][]byte, error) { return nil, nil }
+
+func (p *fakePersister) Save(batches [][]byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saved = append(p.saved, batches...)
+	return nil
+}
+
+func TestReplayBatchRespoolsWhenRetriesExhausted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	m := NewMixpanelWithAuth(ProjectTokenAuth{Token: "tok"})
+	m.IngestBaseUrl = server.URL
+	persister := &fakePersister{}
+	bc := &BatchClient{m: m, opts: BatchOptions{MaxRetries: 1, Persister: persister}}
+
+	bc.replayBatch([]byte(`[{"event":"e"}]`))
+
+	persister.mu.Lock()
+	defer persister.mu.Unlock()
+	if len(persister.saved) != 1 {
+		t.Fatalf("persister.saved = %d batches, want 1 -- a batch that exhausts retries on replay must be re-spooled, not dropped", len(persister.saved))
+	}
+}
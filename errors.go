@@ -0,0 +1,77 @@
+package mixpanel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Sentinel errors callers can test for with errors.Is, regardless of the
+// specific request that failed.
+var (
+	ErrAuthFailed  = errors.New("mixpanel: authentication failed")
+	ErrRateLimited = errors.New("mixpanel: rate limited")
+	ErrNotFound    = errors.New("mixpanel: not found")
+
+	// ErrNoProjectToken is returned by Track, Update, and Alias when the
+	// configured Auth has no project token to embed in the payload
+	// (e.g. a ServiceAccountAuth with Token unset) rather than silently
+	// sending an unauthenticated request.
+	ErrNoProjectToken = errors.New("mixpanel: auth has no project token configured for ingestion")
+)
+
+// MixpanelError is returned when Mixpanel replies with a non-2xx status or
+// a 2xx body of the form {"error": "..."}. Body is the raw response so
+// callers that need more than APIError (e.g. for logging) aren't stuck.
+type MixpanelError struct {
+	Status   int
+	APIError string
+	Request  string
+	Body     []byte
+}
+
+func (e *MixpanelError) Error() string {
+	if e.APIError != "" {
+		return fmt.Sprintf("mixpanel: %s failed (status %d): %s", e.Request, e.Status, e.APIError)
+	}
+	return fmt.Sprintf("mixpanel: %s failed (status %d)", e.Request, e.Status)
+}
+
+// Unwrap lets callers use errors.Is(err, ErrAuthFailed) and friends instead
+// of comparing Status directly.
+func (e *MixpanelError) Unwrap() error {
+	switch e.Status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuthFailed
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return nil
+	}
+}
+
+// checkAPIError inspects a Query API response for either a non-2xx status
+// or an embedded {"error": "..."} body, returning a *MixpanelError for
+// either. body is not required to be a JSON object (e.g. /export's
+// newline-delimited events aren't), so a failed decode is not itself an
+// error here.
+func checkAPIError(request string, status int, body []byte) error {
+	var decoded struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(body, &decoded)
+
+	if status >= 200 && status < 300 && decoded.Error == "" {
+		return nil
+	}
+	return &MixpanelError{Status: status, APIError: decoded.Error, Request: request, Body: body}
+}
+
+// errUnexpectedShape reports that a decoded response didn't have the shape
+// the caller expected, e.g. UserInfo's walk through /engage's results.
+func errUnexpectedShape(request, detail string) error {
+	return &MixpanelError{Request: request, APIError: "unexpected response shape: " + detail}
+}
@@ -0,0 +1,222 @@
+package mixpanel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+const (
+	exportDateFormat = "2006-01-02"
+
+	// initialScanBufferSize and maxScanBufferSize size the bufio.Scanner
+	// used to read /export's newline-delimited JSON. Individual export
+	// lines can be large (deeply nested custom properties), so the
+	// default 64KiB scanner buffer isn't enough.
+	initialScanBufferSize = 64 * 1024
+	maxScanBufferSize     = 10 * 1024 * 1024
+)
+
+// ExportProgressFunc is called once a day's worth of events has been fully
+// read when day-chunking is enabled.
+type ExportProgressFunc func(day string, count int, err error)
+
+// ExportStreamOption configures ExportStream.
+type ExportStreamOption func(*ExportIterator)
+
+// WithDayChunking splits a from_date/to_date export into day-sized
+// sub-requests, executed sequentially as Next() advances, and invokes
+// progress after each day finishes. This lets a single ExportStream call
+// cover months of data without Mixpanel timing out one giant request, and
+// lets the caller surface progress as it goes.
+func WithDayChunking(progress ExportProgressFunc) ExportStreamOption {
+	return func(it *ExportIterator) {
+		it.chunkByDay = true
+		it.progress = progress
+	}
+}
+
+// ExportIterator streams ExportQueryResult values out of /export without
+// buffering the whole response in memory. Callers must call Close when
+// done.
+type ExportIterator struct {
+	m      *Mixpanel
+	ctx    context.Context
+	params map[string]string
+
+	chunkByDay bool
+	progress   ExportProgressFunc
+	days       []string
+	dayIdx     int
+	dayCount   int
+
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+
+	current ExportQueryResult
+	err     error
+	closed  bool
+}
+
+// ExportStream issues the /export GET described by params and returns an
+// iterator over its newline-delimited JSON events.
+func (m *Mixpanel) ExportStream(ctx context.Context, params map[string]string, opts ...ExportStreamOption) (*ExportIterator, error) {
+	it := &ExportIterator{m: m, ctx: ctx, params: params}
+	for _, opt := range opts {
+		opt(it)
+	}
+
+	if it.chunkByDay {
+		days, err := expandDateRange(params["from_date"], params["to_date"])
+		if err != nil {
+			return nil, err
+		}
+		it.days = days
+		if len(days) == 0 {
+			// from_date is after to_date: a valid but empty range, not a
+			// failure to start streaming. Return an iterator whose Next()
+			// reports no events rather than overloading startNextDay's
+			// io.EOF (its "no more days" sentinel) as an ExportStream error.
+			return it, nil
+		}
+		if err := it.startNextDay(); err != nil {
+			return nil, err
+		}
+		return it, nil
+	}
+
+	if err := it.startRequest(it.params); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func expandDateRange(fromDate, toDate string) ([]string, error) {
+	from, err := time.Parse(exportDateFormat, fromDate)
+	if err != nil {
+		return nil, fmt.Errorf("mixpanel: invalid from_date %q: %s", fromDate, err)
+	}
+	to, err := time.Parse(exportDateFormat, toDate)
+	if err != nil {
+		return nil, fmt.Errorf("mixpanel: invalid to_date %q: %s", toDate, err)
+	}
+
+	var days []string
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(exportDateFormat))
+	}
+	return days, nil
+}
+
+// startNextDay issues the request for the next pending day, reporting
+// progress for the day that just finished. It returns io.EOF once there
+// are no more days.
+func (it *ExportIterator) startNextDay() error {
+	if it.dayIdx > 0 && it.progress != nil {
+		it.progress(it.days[it.dayIdx-1], it.dayCount, nil)
+	}
+	if it.dayIdx >= len(it.days) {
+		return io.EOF
+	}
+
+	day := it.days[it.dayIdx]
+	it.dayIdx++
+	it.dayCount = 0
+
+	dayParams := make(map[string]string, len(it.params))
+	for k, v := range it.params {
+		dayParams[k] = v
+	}
+	dayParams["from_date"] = day
+	dayParams["to_date"] = day
+
+	return it.startRequest(dayParams)
+}
+
+func (it *ExportIterator) startRequest(params map[string]string) error {
+	resp, err := it.m.doRequest(it.ctx, it.m.ExportBaseUrl, "export", params)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return checkAPIError("export", resp.StatusCode, body)
+	}
+
+	it.body = resp.Body
+	it.scanner = bufio.NewScanner(resp.Body)
+	it.scanner.Buffer(make([]byte, initialScanBufferSize), maxScanBufferSize)
+	return nil
+}
+
+// Next advances the iterator, returning false when the stream (and, with
+// day-chunking, every day) is exhausted or an error occurs. Malformed
+// lines are skipped and logged, matching ExportQuery's existing tolerance.
+func (it *ExportIterator) Next() bool {
+	if it.err != nil || it.closed || it.scanner == nil {
+		return false
+	}
+
+	for {
+		if it.scanner.Scan() {
+			line := it.scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			var result ExportQueryResult
+			if err := json.Unmarshal(line, &result); err != nil {
+				log.Printf("BAD EVENT %s -- '%s'\n", err.Error(), line)
+				continue
+			}
+			it.current = result
+			it.dayCount++
+			return true
+		}
+
+		if err := it.scanner.Err(); err != nil {
+			it.err = err
+			return false
+		}
+
+		it.body.Close()
+
+		if !it.chunkByDay {
+			return false
+		}
+		if err := it.startNextDay(); err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			return false
+		}
+	}
+}
+
+// Event returns the event produced by the most recent call to Next.
+func (it *ExportIterator) Event() ExportQueryResult {
+	return it.current
+}
+
+// Err returns the first error encountered while streaming, if any.
+func (it *ExportIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator's underlying HTTP response body. It is safe
+// to call more than once.
+func (it *ExportIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	if it.body != nil {
+		return it.body.Close()
+	}
+	return nil
+}
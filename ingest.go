@@ -0,0 +1,171 @@
+package mixpanel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultIngestBaseUrl = "http://api.mixpanel.com"
+)
+
+// Event represents a single historical event to be backfilled via Import.
+// Timestamp and IP are optional; when Timestamp is nil Mixpanel stamps the
+// event with the time it was received, which for Import is almost never
+// what you want.
+type Event struct {
+	Timestamp  *time.Time
+	IP         string
+	Properties map[string]interface{}
+}
+
+// ErrTrackFailed is returned when Mixpanel accepts the HTTP request but
+// rejects the event itself: the classic ingestion endpoints reply with a
+// bare "1" on success and "0" (optionally with an error body) otherwise.
+type ErrTrackFailed struct {
+	Body string
+	Resp *http.Response
+}
+
+func (e ErrTrackFailed) Error() string {
+	return fmt.Sprintf("mixpanel: track failed: %s", e.Body)
+}
+
+// Track records a live event for distinctID. props may be nil.
+func (m *Mixpanel) Track(distinctID, event string, props map[string]interface{}) error {
+	token := m.Auth.projectToken()
+	if token == "" {
+		return ErrNoProjectToken
+	}
+
+	properties := cloneProps(props)
+	properties["token"] = token
+	properties["distinct_id"] = distinctID
+
+	return m.postIngest("track", map[string]interface{}{
+		"event":      event,
+		"properties": properties,
+	}, false)
+}
+
+// Import backfills an event older than the 5-day live-ingest window. The
+// HTTP request is authenticated with the API secret rather than the
+// project token, but /import still requires a project token in the event
+// payload itself, same as Track; Import returns ErrNoProjectToken if
+// m.Auth has none configured.
+//
+// Import shares postIngest with Track on the assumption that /import's
+// request and response shape (base64 "data" form field, bare "1"/"0"
+// body) matches /track's; ingest_test.go pins that assumption down with a
+// fake server so a real contract mismatch fails loudly here rather than
+// surfacing as a misleading ErrTrackFailed in production.
+func (m *Mixpanel) Import(distinctID, event string, ev *Event) error {
+	token := m.Auth.projectToken()
+	if token == "" {
+		return ErrNoProjectToken
+	}
+
+	properties := map[string]interface{}{}
+	if ev != nil {
+		properties = cloneProps(ev.Properties)
+		if ev.IP != "" {
+			properties["ip"] = ev.IP
+		}
+		if ev.Timestamp != nil {
+			properties["time"] = ev.Timestamp.Unix()
+		}
+	}
+	properties["token"] = token
+	properties["distinct_id"] = distinctID
+
+	return m.postIngest("import", map[string]interface{}{
+		"event":      event,
+		"properties": properties,
+	}, true)
+}
+
+// Update applies a People engagement operation (one of $set, $set_once,
+// $add, $append, $union, $unset, $delete) for distinctID.
+func (m *Mixpanel) Update(distinctID string, op string, props map[string]interface{}) error {
+	token := m.Auth.projectToken()
+	if token == "" {
+		return ErrNoProjectToken
+	}
+
+	return m.postIngest("engage", map[string]interface{}{
+		"$token":       token,
+		"$distinct_id": distinctID,
+		op:             props,
+	}, false)
+}
+
+// Alias links oldID and newID so future events under newID are merged into
+// the same Mixpanel profile as oldID.
+func (m *Mixpanel) Alias(oldID, newID string) error {
+	token := m.Auth.projectToken()
+	if token == "" {
+		return ErrNoProjectToken
+	}
+
+	return m.postIngest("track", map[string]interface{}{
+		"event": "$create_alias",
+		"properties": map[string]interface{}{
+			"token":       token,
+			"distinct_id": oldID,
+			"alias":       newID,
+		},
+	}, false)
+}
+
+func cloneProps(props map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(props)+2)
+	for k, v := range props {
+		out[k] = v
+	}
+	return out
+}
+
+func (m *Mixpanel) postIngest(endpoint string, payload map[string]interface{}, useApiSecret bool) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	form := url.Values{}
+	form.Set("data", encoded)
+
+	uri := fmt.Sprintf("%s/%s", m.IngestBaseUrl, endpoint)
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if useApiSecret {
+		if username, password, ok := m.Auth.importBasicAuth(); ok {
+			req.SetBasicAuth(username, password)
+		}
+	}
+
+	resp, err := m.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(string(body)) != "1" {
+		return ErrTrackFailed{Body: string(body), Resp: resp}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package mixpanel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestMixpanel(baseURL string) *Mixpanel {
+	m := NewMixpanel("test-key", "test-secret")
+	m.IngestBaseUrl = baseURL
+	return m
+}
+
+func decodeIngestBody(t *testing.T, r *http.Request) []map[string]interface{} {
+	t.Helper()
+	if err := r.ParseForm(); err != nil {
+		t.Fatalf("ParseForm: %s", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(r.FormValue("data"))
+	if err != nil {
+		t.Fatalf("decode data param: %s", err)
+	}
+
+	// /track and /import both accept either a single event object or a
+	// JSON array of them; normalize to a slice either way.
+	var events []map[string]interface{}
+	if err := json.Unmarshal(raw, &events); err != nil {
+		var single map[string]interface{}
+		if err := json.Unmarshal(raw, &single); err != nil {
+			t.Fatalf("unmarshal data param: %s", err)
+		}
+		events = []map[string]interface{}{single}
+	}
+	return events
+}
+
+func TestTrackSendsTokenAndDistinctID(t *testing.T) {
+	var gotPath string
+	var gotEvents []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotEvents = decodeIngestBody(t, r)
+		w.Write([]byte("1"))
+	}))
+	defer server.Close()
+
+	m := newTestMixpanel(server.URL)
+	if err := m.Track("user-1", "login", map[string]interface{}{"plan": "pro"}); err != nil {
+		t.Fatalf("Track: %s", err)
+	}
+
+	if gotPath != "/track" {
+		t.Errorf("path = %q, want /track", gotPath)
+	}
+	if len(gotEvents) != 1 {
+		t.Fatalf("got %d events, want 1", len(gotEvents))
+	}
+	props, _ := gotEvents[0]["properties"].(map[string]interface{})
+	if props["token"] != "test-key" {
+		t.Errorf("token = %v, want test-key", props["token"])
+	}
+	if props["distinct_id"] != "user-1" {
+		t.Errorf("distinct_id = %v, want user-1", props["distinct_id"])
+	}
+	if props["plan"] != "pro" {
+		t.Errorf("plan = %v, want pro", props["plan"])
+	}
+}
+
+func TestTrackReturnsErrTrackFailedOnRejection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0"))
+	}))
+	defer server.Close()
+
+	m := newTestMixpanel(server.URL)
+	err := m.Track("user-1", "login", nil)
+	if _, ok := err.(ErrTrackFailed); !ok {
+		t.Fatalf("err = %v (%T), want ErrTrackFailed", err, err)
+	}
+}
+
+func TestImportUsesAPISecretBasicAuthAndImportPath(t *testing.T) {
+	var gotPath string
+	var gotUser, gotPass string
+	var gotHasAuth bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotUser, gotPass, gotHasAuth = r.BasicAuth()
+		decodeIngestBody(t, r)
+		w.Write([]byte("1"))
+	}))
+	defer server.Close()
+
+	m := newTestMixpanel(server.URL)
+	err := m.Import("user-1", "signup", &Event{Properties: map[string]interface{}{"source": "backfill"}})
+	if err != nil {
+		t.Fatalf("Import: %s", err)
+	}
+
+	if gotPath != "/import" {
+		t.Errorf("path = %q, want /import", gotPath)
+	}
+	if !gotHasAuth {
+		t.Fatal("expected HTTP Basic auth on /import, got none")
+	}
+	if gotUser != "test-secret" || gotPass != "" {
+		t.Errorf("basic auth = %q:%q, want test-secret:\"\"", gotUser, gotPass)
+	}
+}
+
+func TestImportReturnsErrNoProjectTokenWithoutOne(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("Import should not have made a request with no project token configured")
+	}))
+	defer server.Close()
+
+	m := NewMixpanelWithAuth(ServiceAccountAuth{Username: "svc", Secret: "s", ProjectID: "1"})
+	m.IngestBaseUrl = server.URL
+
+	err := m.Import("user-1", "signup", nil)
+	if err != ErrNoProjectToken {
+		t.Fatalf("err = %v, want ErrNoProjectToken", err)
+	}
+}
+
+func TestUpdateSendsEngageOperation(t *testing.T) {
+	var gotEvents []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEvents = decodeIngestBody(t, r)
+		w.Write([]byte("1"))
+	}))
+	defer server.Close()
+
+	m := newTestMixpanel(server.URL)
+	if err := m.Update("user-1", "$set", map[string]interface{}{"plan": "pro"}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	if gotEvents[0]["$token"] != "test-key" {
+		t.Errorf("$token = %v, want test-key", gotEvents[0]["$token"])
+	}
+	set, _ := gotEvents[0]["$set"].(map[string]interface{})
+	if set["plan"] != "pro" {
+		t.Errorf("$set.plan = %v, want pro", set["plan"])
+	}
+}
@@ -2,7 +2,7 @@ package mixpanel
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,13 +11,17 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
 	"strings"
 	"time"
 )
 
 const (
 	DEFAULT_EXPIRE_IN_DAYS int64 = 5
+
+	DefaultBaseUrl       = "http://mixpanel.com/api/2.0"
+	DefaultExportBaseUrl = "http://data.mixpanel.com/api/2.0"
+
+	defaultHTTPTimeout = 30 * time.Second
 )
 
 type MixpanelAuth struct {
@@ -26,8 +30,37 @@ type MixpanelAuth struct {
 
 type Mixpanel struct {
 	*MixpanelAuth
-	Format  string
-	BaseUrl string
+	Auth          Auth
+	Format        string
+	BaseUrl       string
+	ExportBaseUrl string
+	IngestBaseUrl string
+	UserAgent     string
+
+	// HTTPClient is used for every request. It defaults to a client with
+	// sane timeouts; override it (or its Transport) for custom dialing,
+	// proxying, or testing.
+	HTTPClient http.Client
+}
+
+// Option configures a Mixpanel constructed by NewMixpanel, NewMixpanelWithAuth,
+// or NewMixpanelFromEnv.
+type Option func(*Mixpanel)
+
+// WithBaseURL overrides the Query API host (default DefaultBaseUrl).
+func WithBaseURL(baseURL string) Option {
+	return func(m *Mixpanel) { m.BaseUrl = baseURL }
+}
+
+// WithFormat overrides the response format requested from the Query API
+// (default "json").
+func WithFormat(format string) Option {
+	return func(m *Mixpanel) { m.Format = format }
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(userAgent string) Option {
+	return func(m *Mixpanel) { m.UserAgent = userAgent }
 }
 
 type EventQueryResult struct {
@@ -62,19 +95,56 @@ type TopEventsResult struct {
 
 type CommonEventsResult []string
 
-func NewMixpanelFromEnv() *Mixpanel {
-	return NewMixpanel(os.Getenv("MIXPANEL_API_KEY"), os.Getenv("MIXPANEL_SECRET"))
+// NewMixpanelFromEnv picks an Auth from whichever credentials are present
+// in the environment, preferring the service account over the legacy
+// api_key/secret pair, and a bare project token over either when that's
+// all ingestion needs: MIXPANEL_SERVICE_ACCOUNT+MIXPANEL_SERVICE_SECRET
+// (+MIXPANEL_PROJECT_ID) for ServiceAccountAuth, MIXPANEL_TOKEN for
+// ProjectTokenAuth, otherwise MIXPANEL_API_KEY+MIXPANEL_SECRET for
+// LegacyMD5Auth. MIXPANEL_TOKEN is also honored alongside
+// MIXPANEL_SERVICE_ACCOUNT, since a service account has no project token
+// of its own and Track/Update/Alias need one.
+func NewMixpanelFromEnv(opts ...Option) *Mixpanel {
+	if username := os.Getenv("MIXPANEL_SERVICE_ACCOUNT"); username != "" {
+		return NewMixpanelWithAuth(ServiceAccountAuth{
+			Username:  username,
+			Secret:    os.Getenv("MIXPANEL_SERVICE_SECRET"),
+			ProjectID: os.Getenv("MIXPANEL_PROJECT_ID"),
+			Token:     os.Getenv("MIXPANEL_TOKEN"),
+		}, opts...)
+	}
+	if token := os.Getenv("MIXPANEL_TOKEN"); token != "" {
+		return NewMixpanelWithAuth(ProjectTokenAuth{Token: token}, opts...)
+	}
+	return NewMixpanel(os.Getenv("MIXPANEL_API_KEY"), os.Getenv("MIXPANEL_SECRET"), opts...)
 }
 
-func NewMixpanel(apiKey, secret string) *Mixpanel {
+// NewMixpanel constructs a Mixpanel using the legacy api_key/secret
+// signature scheme. Prefer NewMixpanelWithAuth(ServiceAccountAuth{...}) for
+// new integrations; Mixpanel is deprecating this scheme.
+func NewMixpanel(apiKey, secret string, opts ...Option) *Mixpanel {
 	ma, err := NewMixpanelAuth(apiKey, secret)
 	if err != nil {
 		log.Fatal(err)
 	}
-	m := new(Mixpanel)
+	m := NewMixpanelWithAuth(LegacyMD5Auth{ApiKey: apiKey, Secret: secret}, opts...)
 	m.MixpanelAuth = ma
+	return m
+}
+
+// NewMixpanelWithAuth constructs a Mixpanel using the given Auth, e.g.
+// ServiceAccountAuth or ProjectTokenAuth.
+func NewMixpanelWithAuth(auth Auth, opts ...Option) *Mixpanel {
+	m := new(Mixpanel)
+	m.Auth = auth
 	m.Format = "json"
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
+	m.BaseUrl = DefaultBaseUrl
+	m.ExportBaseUrl = DefaultExportBaseUrl
+	m.IngestBaseUrl = DefaultIngestBaseUrl
+	m.HTTPClient = http.Client{Timeout: defaultHTTPTimeout}
+	for _, opt := range opts {
+		opt(m)
+	}
 	return m
 }
 
@@ -94,47 +164,53 @@ func (m *Mixpanel) AddExpire(params *map[string]string) {
 	}
 }
 
+// AddSig signs params with the legacy api_key+md5 scheme, kept for callers
+// that built requests around it directly. doRequest no longer calls this;
+// it delegates to m.Auth, which only takes this code path for
+// LegacyMD5Auth.
 func (m *Mixpanel) AddSig(params *map[string]string) {
-	delete(*params, "sig")
-	keys := make([]string, 0)
-
-	(*params)["api_key"] = m.ApiKey
-	(*params)["format"] = m.Format
-
-	for k, _ := range *params {
-		keys = append(keys, k)
+	if m.MixpanelAuth == nil {
+		return
 	}
-	sort.StringSlice(keys).Sort()
-	// fmt.Println(s)
+	LegacyMD5Auth{ApiKey: m.ApiKey, Secret: m.Secret}.signQuery(*params, m.Format)
+}
 
-	var buffer bytes.Buffer
-	for _, key := range keys {
-		value := (*params)[key]
-		buffer.WriteString(fmt.Sprintf("%s=%s", key, value))
+// MakeRequest issues a GET against baseURL/action with params, honoring
+// ctx's deadline and cancellation. baseURL lets callers target either the
+// Query API or the Export API with the same *Mixpanel.
+func (m *Mixpanel) MakeRequest(ctx context.Context, baseURL, action string, params map[string]string) ([]byte, error) {
+	resp, err := m.doRequest(ctx, baseURL, action, params)
+	if err != nil {
+		return []byte{}, err
 	}
-	buffer.WriteString(m.Secret)
-	// fmt.Println(buffer.String())
-
-	hash := md5.New()
-	hash.Write(buffer.Bytes())
-	sigHex := fmt.Sprintf("%x", hash.Sum([]byte{}))
-	(*params)["sig"] = sigHex
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return body, err
+	}
+	if apiErr := checkAPIError(action, resp.StatusCode, body); apiErr != nil {
+		return body, apiErr
+	}
+	return body, nil
 }
 
-func (m *Mixpanel) MakeRequest(action string, params map[string]string) ([]byte, error) {
+// doRequest builds and issues the signed GET for baseURL/action, returning
+// the raw response so callers that want to stream the body (ExportStream)
+// don't have to buffer it first.
+func (m *Mixpanel) doRequest(ctx context.Context, baseURL, action string, params map[string]string) (*http.Response, error) {
 	event, ok := params["event"]
 	delete(params, "event")
 	if ok && event != "" {
 		events := strings.Split(event, ",")
-		bytes, err := json.Marshal(events)
+		encoded, err := json.Marshal(events)
 		if err != nil {
-			return []byte{}, err
+			return nil, err
 		}
-		params["event"] = string(bytes)
+		params["event"] = string(encoded)
 	}
 
 	m.AddExpire(&params)
-	m.AddSig(&params)
+	m.Auth.signQuery(params, m.Format)
 
 	var buffer bytes.Buffer
 	for key, value := range params {
@@ -142,32 +218,26 @@ func (m *Mixpanel) MakeRequest(action string, params map[string]string) ([]byte,
 		buffer.WriteString(fmt.Sprintf("%s=%s&", key, value))
 	}
 
-	uri := fmt.Sprintf("%s/%s?%s", m.BaseUrl, action, buffer.String())
+	uri := fmt.Sprintf("%s/%s?%s", baseURL, action, buffer.String())
 	uri = uri[:len(uri)-1]
-	// fmt.Println(uri)
 
-	var bytes []byte
-	client := new(http.Client)
-	req, err := http.NewRequest("GET", uri, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
-		return bytes, err
+		return nil, err
 	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
-	if err != nil {
-		return bytes, err
+	if m.UserAgent != "" {
+		req.Header.Set("User-Agent", m.UserAgent)
 	}
-	// fmt.Printf("%+v",resp)
-	defer resp.Body.Close()
-	bytes, err = ioutil.ReadAll(resp.Body)
-	// fmt.Println(string(bytes))
-	return bytes, err
+	if username, password, ok := m.Auth.queryBasicAuth(); ok {
+		req.SetBasicAuth(username, password)
+	}
+	return m.HTTPClient.Do(req)
 }
 
-func (m *Mixpanel) EventQuery(params map[string]string) (EventQueryResult, error) {
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
+func (m *Mixpanel) EventQuery(ctx context.Context, params map[string]string) (EventQueryResult, error) {
 	var result EventQueryResult
-	bytes, err := m.MakeRequest("events/properties", params)
+	bytes, err := m.MakeRequest(ctx, m.BaseUrl, "events/properties", params)
 	if err != nil {
 		return result, err
 	}
@@ -175,10 +245,9 @@ func (m *Mixpanel) EventQuery(params map[string]string) (EventQueryResult, error
 	return result, err
 }
 
-func (m *Mixpanel) ExportQuery(params map[string]string) ([]ExportQueryResult, error) {
-	m.BaseUrl = "http://data.mixpanel.com/api/2.0"
+func (m *Mixpanel) ExportQuery(ctx context.Context, params map[string]string) ([]ExportQueryResult, error) {
 	var results []ExportQueryResult
-	bytes, err := m.MakeRequest("export", params)
+	bytes, err := m.MakeRequest(ctx, m.ExportBaseUrl, "export", params)
 	if err != nil {
 		return results, err
 	}
@@ -198,35 +267,48 @@ func (m *Mixpanel) ExportQuery(params map[string]string) ([]ExportQueryResult, e
 	return results, nil
 }
 
-func (m *Mixpanel) PeopleQuery(params map[string]string) (map[string]interface{}, error) {
+func (m *Mixpanel) PeopleQuery(ctx context.Context, params map[string]string) (map[string]interface{}, error) {
 	var result map[string]interface{}
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
-	bytes, err := m.MakeRequest("engage", params)
+	bytes, err := m.MakeRequest(ctx, m.BaseUrl, "engage", params)
 	if err != nil {
 		return result, err
 	}
-	json.Unmarshal(bytes, &result)
+	if err := json.Unmarshal(bytes, &result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-func (m *Mixpanel) UserInfo(id string) (map[string]interface{}, error) {
+func (m *Mixpanel) UserInfo(ctx context.Context, id string) (map[string]interface{}, error) {
 	params := map[string]string{
 		"distinct_id": id,
 	}
-	var result map[string]interface{}
-	result, err := m.PeopleQuery(params)
+	result, err := m.PeopleQuery(ctx, params)
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+
+	results, ok := result["results"].([]interface{})
+	if !ok {
+		return nil, errUnexpectedShape("engage", "\"results\" is not an array")
 	}
-	if len(result["results"].([]interface{})) == 0 {
+	if len(results) == 0 {
 		return make(map[string]interface{}), nil
 	}
-	return result["results"].([]interface{})[0].(map[string]interface{})["$properties"].(map[string]interface{}), nil
+
+	profile, ok := results[0].(map[string]interface{})
+	if !ok {
+		return nil, errUnexpectedShape("engage", "results[0] is not an object")
+	}
+	properties, ok := profile["$properties"].(map[string]interface{})
+	if !ok {
+		return nil, errUnexpectedShape("engage", "results[0].$properties is not an object")
+	}
+	return properties, nil
 }
 
-func (m *Mixpanel) SegmentationQuery(params map[string]string) (SegmentationQueryResult, error) {
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
-	bytes, err := m.MakeRequest("segmentation", params)
+func (m *Mixpanel) SegmentationQuery(ctx context.Context, params map[string]string) (SegmentationQueryResult, error) {
+	bytes, err := m.MakeRequest(ctx, m.BaseUrl, "segmentation", params)
 
 	var result SegmentationQueryResult
 	if err != nil {
@@ -237,11 +319,9 @@ func (m *Mixpanel) SegmentationQuery(params map[string]string) (SegmentationQuer
 	return result, err
 }
 
-func (m *Mixpanel) TopEvents(params map[string]string) (TopEventsResult, error) {
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
-
+func (m *Mixpanel) TopEvents(ctx context.Context, params map[string]string) (TopEventsResult, error) {
 	var result TopEventsResult
-	bytes, err := m.MakeRequest("events/top", params)
+	bytes, err := m.MakeRequest(ctx, m.BaseUrl, "events/top", params)
 	if err != nil {
 		return result, err
 	}
@@ -251,9 +331,8 @@ func (m *Mixpanel) TopEvents(params map[string]string) (TopEventsResult, error)
 
 }
 
-func (m *Mixpanel) MostCommonEventsLast31Days(params map[string]string) (CommonEventsResult, error) {
-	m.BaseUrl = "http://mixpanel.com/api/2.0"
-	bytes, err := m.MakeRequest("events/names", params)
+func (m *Mixpanel) MostCommonEventsLast31Days(ctx context.Context, params map[string]string) (CommonEventsResult, error) {
+	bytes, err := m.MakeRequest(ctx, m.BaseUrl, "events/names", params)
 
 	var result CommonEventsResult
 	if err != nil {